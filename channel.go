@@ -13,7 +13,9 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -30,6 +32,86 @@ var (
 	isAFVSockSupportedFunc = isAFVSockSupported
 )
 
+// Yamux keepalive defaults, tunable via agent.channel_keepalive and
+// agent.channel_keepalive_interval on the kernel cmdline.
+var (
+	yamuxKeepAliveEnabled       = true
+	yamuxKeepAliveInterval      = 30 * time.Second
+	yamuxConnectionWriteTimeout = 30 * time.Second
+
+	yamuxKeepAliveConfigOnce sync.Once
+)
+
+const (
+	keepAliveCmdlineOption         = "agent.channel_keepalive"
+	keepAliveIntervalCmdlineOption = "agent.channel_keepalive_interval"
+)
+
+// configureYamuxKeepAlive applies the keepalive cmdline overrides, if any,
+// to the yamuxKeepAlive* package vars. It only does real work once: every
+// serialChannel in the process shares the same keepalive configuration.
+func configureYamuxKeepAlive() error {
+	var err error
+
+	yamuxKeepAliveConfigOnce.Do(func() {
+		err = applyYamuxKeepAliveCmdline()
+	})
+
+	return err
+}
+
+func applyYamuxKeepAliveCmdline() error {
+	if value, err := getCmdlineOption(keepAliveCmdlineOption); err != nil {
+		return err
+	} else if value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q: %v", keepAliveCmdlineOption, value, err)
+		}
+		yamuxKeepAliveEnabled = enabled
+	}
+
+	if value, err := getCmdlineOption(keepAliveIntervalCmdlineOption); err != nil {
+		return err
+	} else if value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q: %v", keepAliveIntervalCmdlineOption, value, err)
+		}
+		yamuxKeepAliveInterval = interval
+	}
+
+	return nil
+}
+
+// procCmdlineFile is the path read to look for explicit channel selection
+// options passed by the runtime on the kernel command line.
+var procCmdlineFile = "/proc/cmdline"
+
+// Kernel cmdline options allowing the runtime to pin down the exact channel
+// to use instead of letting newChannel probe for one. These are useful on
+// hosts where the vsock/serial auto-detection races (e.g. a vsock device
+// node that exists but isn't actually backed by a hot-plugged vhost-vsock).
+const (
+	channelCmdlineOption         = "agent.channel"
+	vsockPortCmdlineOption       = "agent.vsock_port"
+	serialNameCmdlineOption      = "agent.serial_name"
+	hybridVSockPathCmdlineOption = "agent.hybrid_vsock_path"
+)
+
+// commType identifies which channel implementation the agent should use.
+type commType int
+
+const (
+	// unknownCh means no explicit channel was requested: newChannel probes
+	// for whichever of vsock or serial is available.
+	unknownCh commType = iota
+	serialCh
+	vsockCh
+	hybridVSockCh
+	unixCh
+)
+
 type channel interface {
 	setup() error
 	wait() error
@@ -37,6 +119,55 @@ type channel interface {
 	teardown() error
 }
 
+// getCmdlineOption looks up a "key=value" option on the kernel command
+// line and returns its value, or the empty string if the option isn't
+// present. A missing procCmdlineFile (e.g. running the agent outside a VM,
+// against a unix-domain dev channel) is treated the same as no options
+// being set, rather than an error.
+func getCmdlineOption(key string) (string, error) {
+	data, err := ioutil.ReadFile(procCmdlineFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	prefix := key + "="
+	for _, field := range strings.Fields(string(data)) {
+		if strings.HasPrefix(field, prefix) {
+			return strings.TrimPrefix(field, prefix), nil
+		}
+	}
+
+	return "", nil
+}
+
+// explicitCommType returns the commType requested through the
+// "agent.channel=" kernel cmdline option, or unknownCh if the option was
+// not specified.
+func explicitCommType() (commType, error) {
+	value, err := getCmdlineOption(channelCmdlineOption)
+	if err != nil {
+		return unknownCh, err
+	}
+
+	switch value {
+	case "":
+		return unknownCh, nil
+	case "serial":
+		return serialCh, nil
+	case "vsock":
+		return vsockCh, nil
+	case "hybrid-vsock", "hvsock":
+		return hybridVSockCh, nil
+	case "unix":
+		return unixCh, nil
+	default:
+		return unknownCh, fmt.Errorf("unknown %s value %q", channelCmdlineOption, value)
+	}
+}
+
 // Creates a new channel to communicate the agent with the proxy or shim.
 // The runtime hot plugs a serial port or a vsock PCI depending of the configuration
 // file and if the host has support for vsocks. newChannel iterates in a loop looking
@@ -49,6 +180,67 @@ func newChannel(ctx context.Context) (channel, error) {
 	span, _ := trace(ctx, "channel", "newChannel")
 	defer span.Finish()
 
+	setupAgentLogChannel()
+
+	wantedType, err := explicitCommType()
+	if err != nil {
+		return nil, err
+	}
+
+	vsockPort, err := cmdlineVSockPort()
+	if err != nil {
+		return nil, err
+	}
+
+	serialName, err := cmdlineSerialName()
+	if err != nil {
+		return nil, err
+	}
+
+	hybridVSockPath, err := cmdlineHybridVSockPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// A hybrid vsock socket path doesn't need probing for: the agent owns
+	// and creates that socket itself, so go straight to it.
+	if wantedType == hybridVSockCh || hybridVSockPath != "" {
+		if hybridVSockPath == "" {
+			return nil, fmt.Errorf("%s=hybrid-vsock was requested but %s was not set", channelCmdlineOption, hybridVSockPathCmdlineOption)
+		}
+
+		span.SetTag("channel-type", "hybrid-vsock")
+		span.SetTag("hybrid-vsock-path", hybridVSockPath)
+		return &hybridVSockChannel{hostSocketPath: hybridVSockPath}, nil
+	}
+
+	unixSocketPath, err := cmdlineUnixSocketPath()
+	if err != nil {
+		return nil, err
+	}
+
+	// Likewise, the unix dev/test channel is a fixed, agent-owned socket
+	// path: no vsock/serial probing needed, so development and CI work
+	// without a vsock-capable kernel or a virtio-serial device.
+	if wantedType == unixCh || unixSocketPath != "" {
+		if unixSocketPath == "" {
+			return nil, fmt.Errorf("%s=unix was requested but %s was not set", channelCmdlineOption, unixSocketPathCmdlineOption)
+		}
+
+		allowedUIDs, err := cmdlineUnixSocketAllowedUIDs()
+		if err != nil {
+			return nil, err
+		}
+
+		span.SetTag("channel-type", "unix")
+		span.SetTag("unix-socket-path", unixSocketPath)
+		return &unixChannel{socketPath: unixSocketPath, allowedUIDs: allowedUIDs}, nil
+	}
+
+	if wantedType != unknownCh {
+		span.SetTag("channel-type-requested", wantedType)
+	}
+
 	var serialErr error
 	var serialPath string
 	var vsockErr error
@@ -56,23 +248,36 @@ func newChannel(ctx context.Context) (channel, error) {
 
 	for i := 0; i < channelExistMaxTries; i++ {
 		// check vsock path
-		if _, err := os.Stat(vSockDevPath); err == nil {
-			if vSockSupported, vsockErr = isAFVSockSupportedFunc(); vSockSupported && vsockErr == nil {
-				span.SetTag("channel-type", "vsock")
-				return &vSockChannel{}, nil
+		if wantedType != serialCh {
+			if _, err := os.Stat(vSockDevPath); err == nil {
+				if vSockSupported, vsockErr = isAFVSockSupportedFunc(); vSockSupported && vsockErr == nil {
+					span.SetTag("channel-type", "vsock")
+					return &vSockChannel{port: vsockPort}, nil
+				}
 			}
 		}
 
 		// Check serial port path
-		if serialPath, serialErr = findVirtualSerialPath(serialChannelName); serialErr == nil {
-			span.SetTag("channel-type", "serial")
-			span.SetTag("serial-path", serialPath)
-			return &serialChannel{serialPath: serialPath}, nil
+		if wantedType != vsockCh {
+			if serialPath, serialErr = findVirtualSerialPath(serialName); serialErr == nil {
+				span.SetTag("channel-type", "serial")
+				span.SetTag("serial-path", serialPath)
+				return &serialChannel{serialPath: serialPath}, nil
+			}
 		}
 
 		time.Sleep(channelExistWaitTime)
 	}
 
+	// When the channel type was explicitly requested, don't fall back to
+	// the other probe: report a clear, specific error instead.
+	switch wantedType {
+	case vsockCh:
+		return nil, fmt.Errorf("%s=vsock was requested but no vsock device was found: %v", channelCmdlineOption, vsockErr)
+	case serialCh:
+		return nil, fmt.Errorf("%s=serial was requested but no virtio-serial port named %q was found: %v", channelCmdlineOption, serialName, serialErr)
+	}
+
 	if serialErr != nil {
 		agentLog.WithError(serialErr).Error("Serial port not found")
 	}
@@ -84,7 +289,56 @@ func newChannel(ctx context.Context) (channel, error) {
 	return nil, fmt.Errorf("Neither vsocks nor serial ports were found")
 }
 
+// cmdlineVSockPort returns the vsock port to listen on, honoring an
+// "agent.vsock_port=" override on the kernel command line and falling back
+// to vSockPort otherwise.
+func cmdlineVSockPort() (uint32, error) {
+	value, err := getCmdlineOption(vsockPortCmdlineOption)
+	if err != nil {
+		return 0, err
+	}
+
+	if value == "" {
+		return vSockPort, nil
+	}
+
+	port, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q: %v", vsockPortCmdlineOption, value, err)
+	}
+
+	return uint32(port), nil
+}
+
+// cmdlineSerialName returns the virtio-serial port name to look for,
+// honoring an "agent.serial_name=" override on the kernel command line and
+// falling back to serialChannelName otherwise.
+func cmdlineSerialName() (string, error) {
+	value, err := getCmdlineOption(serialNameCmdlineOption)
+	if err != nil {
+		return "", err
+	}
+
+	if value == "" {
+		return serialChannelName, nil
+	}
+
+	return value, nil
+}
+
+// cmdlineHybridVSockPath returns the host-side AF_UNIX socket path to
+// speak the hybrid vsock protocol over, as set by the
+// "agent.hybrid_vsock_path=" kernel cmdline option, or the empty string
+// if it wasn't set.
+func cmdlineHybridVSockPath() (string, error) {
+	return getCmdlineOption(hybridVSockPathCmdlineOption)
+}
+
 type vSockChannel struct {
+	// port is the vsock port to listen on. A zero value means "use the
+	// vSockPort default", so the zero-value vSockChannel{} keeps behaving
+	// the way it always has.
+	port uint32
 }
 
 func (c *vSockChannel) setup() error {
@@ -96,7 +350,12 @@ func (c *vSockChannel) wait() error {
 }
 
 func (c *vSockChannel) listen() (net.Listener, error) {
-	l, err := vsock.Listen(vSockPort)
+	port := c.port
+	if port == 0 {
+		port = vSockPort
+	}
+
+	l, err := vsock.Listen(port)
 	if err != nil {
 		return nil, err
 	}
@@ -110,11 +369,28 @@ func (c *vSockChannel) teardown() error {
 
 type serialChannel struct {
 	serialPath string
+
+	// connMu guards serialConn, which is replaced (not just mutated) by
+	// reopenSerialConn() when the reconnect path in serialYamuxListener
+	// has to recover from a closed connection.
+	connMu     sync.Mutex
 	serialConn *os.File
-	waitCh     <-chan struct{}
+
+	// waitResult carries the outcome of the pending wait() call from
+	// onEvent, once this channel has been registered with the shared
+	// channelEpoller.
+	waitResult     chan error
+	waitResultOnce sync.Once
+
+	mu       sync.Mutex
+	listener *serialYamuxListener
 }
 
 func (c *serialChannel) setup() error {
+	if err := configureYamuxKeepAlive(); err != nil {
+		return err
+	}
+
 	// Open serial channel.
 	file, err := os.OpenFile(c.serialPath, os.O_RDWR, os.ModeDevice)
 	if err != nil {
@@ -126,55 +402,90 @@ func (c *serialChannel) setup() error {
 	return nil
 }
 
-func (c *serialChannel) wait() error {
-	var event unix.EpollEvent
-	var events [1]unix.EpollEvent
+// reopenSerialConn reopens the underlying serial device at c.serialPath,
+// replacing c.serialConn. yamux.Session.Close() (as triggered internally
+// by a keepalive timeout) closes the io.ReadWriteCloser it was built on,
+// i.e. it closes c.serialConn itself -- so recovering from that requires
+// a fresh *os.File, not a new yamux.Session over the now-dead one.
+func (c *serialChannel) reopenSerialConn() error {
+	file, err := os.OpenFile(c.serialPath, os.O_RDWR, os.ModeDevice)
+	if err != nil {
+		return err
+	}
+
+	c.connMu.Lock()
+	old := c.serialConn
+	c.serialConn = file
+	c.connMu.Unlock()
+
+	if old != nil {
+		// Already closed by yamux in the case we care about; Close
+		// again just to release the fd if it somehow wasn't.
+		old.Close()
+	}
+
+	return nil
+}
+
+// fd implements epoller, exposing the serial port's FD to the shared
+// channelEpoller.
+func (c *serialChannel) fd() int32 {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	return int32(c.serialConn.Fd())
+}
+
+// onEvent implements epoller. It is invoked by the shared channelEpoller
+// whenever it sees an EPOLLOUT/EPOLLHUP/EPOLLERR event for this channel's
+// FD, and unblocks the wait() call below. EPOLLOUT takes priority over
+// EPOLLERR, matching the original single-epoll wait() loop: a connection
+// becoming writable is treated as success even if an error flag is also
+// set on the same event.
+func (c *serialChannel) onEvent(events uint32) error {
+	agentLog.WithField("events", events).Debug("New serial channel event")
+
+	if events&unix.EPOLLOUT != 0 {
+		c.signalWait(nil)
+		return nil
+	}
 
-	fd := c.serialConn.Fd()
+	if events&unix.EPOLLERR != 0 {
+		c.signalWait(fmt.Errorf("serial port IO failure"))
+		return nil
+	}
+
+	// EPOLLHUP alone means there's no connection yet: keep waiting.
+	return nil
+}
+
+func (c *serialChannel) signalWait(err error) {
+	c.waitResultOnce.Do(func() {
+		c.waitResult <- err
+		close(c.waitResult)
+	})
+}
+
+func (c *serialChannel) wait() error {
+	fd := c.fd()
 	if fd == 0 {
 		return fmt.Errorf("serial port IO closed")
 	}
 
-	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	epoller, err := getSharedChannelEpoller()
 	if err != nil {
 		return err
 	}
-	defer unix.Close(epfd)
-
-	// EPOLLOUT: Writable when there is a connection
-	// EPOLLET: Edge trigger as EPOLLHUP is always on when there is no connection
-	// 0xffffffff: EPOLLET is negative and cannot fit in uint32 in golang
-	event.Events = unix.EPOLLOUT | unix.EPOLLET&0xffffffff
-	event.Fd = int32(fd)
-	if err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, int(fd), &event); err != nil {
-		return err
-	}
-	defer unix.EpollCtl(epfd, unix.EPOLL_CTL_DEL, int(fd), nil)
 
-	for {
-		nev, err := unix.EpollWait(epfd, events[:], -1)
-		if err != nil {
-			return err
-		}
+	c.waitResult = make(chan error, 1)
+	c.waitResultOnce = sync.Once{}
 
-		for i := 0; i < nev; i++ {
-			ev := events[i]
-			if ev.Fd == int32(fd) {
-				agentLog.WithField("events", ev.Events).Debug("New serial channel event")
-				if ev.Events&unix.EPOLLOUT != 0 {
-					return nil
-				}
-				if ev.Events&unix.EPOLLERR != 0 {
-					return fmt.Errorf("serial port IO failure")
-				}
-				if ev.Events&unix.EPOLLHUP != 0 {
-					continue
-				}
-			}
-		}
+	if err := epoller.add(c); err != nil {
+		return err
 	}
+	defer epoller.remove(c)
 
-	// Never reach here
+	return <-c.waitResult
 }
 
 // yamuxWriter is a type responsible for logging yamux messages to the agent
@@ -195,56 +506,268 @@ func (yw yamuxWriter) Write(bytes []byte) (int, error) {
 }
 
 func (c *serialChannel) listen() (net.Listener, error) {
+	session, err := c.newYamuxSession()
+	if err != nil {
+		return nil, wrapYamuxErr(err)
+	}
+
+	l := &serialYamuxListener{c: c, session: session, closeCh: session.CloseChan()}
+
+	c.mu.Lock()
+	c.listener = l
+	c.mu.Unlock()
+
+	return l, nil
+}
+
+// newYamuxSession creates a new yamux server session over the current
+// serial connection, applying the keepalive knobs configured via
+// configureYamuxKeepAlive.
+func (c *serialChannel) newYamuxSession() (*yamux.Session, error) {
 	config := yamux.DefaultConfig()
-	// yamux client runs on the proxy side, sometimes the client is
-	// handling other requests and it's not able to response to the
-	// ping sent by the server and the communication is closed. To
-	// avoid any IO timeouts in the communication between agent and
-	// proxy, keep alive should be disabled.
-	config.EnableKeepAlive = false
 	config.LogOutput = yamuxWriter{}
 
-	// Initialize Yamux server.
-	session, err := yamux.Server(c.serialConn, config)
-	if err != nil {
-		return nil, err
-	}
-	c.waitCh = session.CloseChan()
+	// yamux client runs on the proxy side; keepalive used to be disabled
+	// entirely to dodge proxy-side latency triggering IO timeouts, but
+	// that left dead sessions undetected indefinitely. It's enabled by
+	// default now, with a generous write timeout and a tunable interval
+	// (see agent.channel_keepalive / agent.channel_keepalive_interval).
+	config.EnableKeepAlive = yamuxKeepAliveEnabled
+	config.KeepAliveInterval = yamuxKeepAliveInterval
+	config.ConnectionWriteTimeout = yamuxConnectionWriteTimeout
 
-	return session, nil
+	c.connMu.Lock()
+	conn := c.serialConn
+	c.connMu.Unlock()
+
+	return yamux.Server(conn, config)
 }
 
 func (c *serialChannel) teardown() error {
-	// wait for the session to be fully shutdown first
-	if c.waitCh != nil {
+	c.mu.Lock()
+	l := c.listener
+	c.mu.Unlock()
+
+	if l != nil {
+		// Mark the listener as closing first, so a reconnect racing
+		// this teardown gives up instead of logging a spurious
+		// "closed unexpectedly" and retrying against a connection
+		// that's intentionally going away.
+		closeCh := l.markClosing()
+
+		if err := l.closeCurrentSession(); err != nil {
+			return err
+		}
+
 		t := time.NewTimer(channelCloseTimeout)
 		select {
-		case <-c.waitCh:
+		case <-closeCh:
 			t.Stop()
 		case <-t.C:
 			return fmt.Errorf("timeout waiting for yamux channel to close")
 		}
 	}
-	return c.serialConn.Close()
+
+	c.connMu.Lock()
+	conn := c.serialConn
+	c.connMu.Unlock()
+
+	return conn.Close()
+}
+
+// serialYamuxReconnectMaxAttempts/serialYamuxReconnectBackoff bound how
+// hard serialYamuxListener.Accept retries reopening the serial device and
+// rebuilding a yamux session after an unexpected close (e.g. a keepalive
+// timeout), so a persistently-failing reopen doesn't spin forever.
+const (
+	serialYamuxReconnectMaxAttempts = 5
+	serialYamuxReconnectBackoff     = 500 * time.Millisecond
+)
+
+// serialYamuxListener wraps a yamux.Session so that a keepalive-induced
+// close doesn't require an agent restart: Accept transparently reopens
+// the serial device and rebuilds a yamux server on it, since yamux's own
+// Close() (as triggered internally by a keepalive timeout) closes the
+// underlying serial connection it was built on -- rebuilding a session
+// over that same, now-dead *os.File can never succeed. Reconnecting stops
+// once the listener is closed on purpose, by Close() or teardown(), or
+// after serialYamuxReconnectMaxAttempts failed attempts in a row.
+type serialYamuxListener struct {
+	c *serialChannel
+
+	mu      sync.Mutex
+	session *yamux.Session
+	closeCh <-chan struct{}
+	closing bool
 }
 
+func (l *serialYamuxListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		session := l.session
+		l.mu.Unlock()
+
+		conn, err := session.Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		if l.isClosing() {
+			return nil, wrapYamuxErr(err)
+		}
+
+		agentLog.WithError(err).Warn("yamux session closed unexpectedly, reconnecting")
+
+		newSession, reErr := l.reconnect()
+		if reErr != nil {
+			return nil, wrapYamuxErr(reErr)
+		}
+
+		l.mu.Lock()
+		l.session = newSession
+		l.closeCh = newSession.CloseChan()
+		l.mu.Unlock()
+	}
+}
+
+// reconnect reopens the serial device and rebuilds a yamux session on it,
+// retrying with a short backoff up to serialYamuxReconnectMaxAttempts
+// times before giving up.
+func (l *serialYamuxListener) reconnect() (*yamux.Session, error) {
+	var lastErr error
+
+	for attempt := 1; attempt <= serialYamuxReconnectMaxAttempts; attempt++ {
+		if l.isClosing() {
+			return nil, fmt.Errorf("serial yamux listener is closing")
+		}
+
+		if err := l.c.reopenSerialConn(); err != nil {
+			lastErr = err
+			time.Sleep(serialYamuxReconnectBackoff)
+			continue
+		}
+
+		session, err := l.c.newYamuxSession()
+		if err != nil {
+			lastErr = err
+			time.Sleep(serialYamuxReconnectBackoff)
+			continue
+		}
+
+		return session, nil
+	}
+
+	return nil, fmt.Errorf("giving up reconnecting serial yamux channel after %d attempts: %v", serialYamuxReconnectMaxAttempts, lastErr)
+}
+
+func (l *serialYamuxListener) closeCurrentSession() error {
+	l.mu.Lock()
+	session := l.session
+	l.mu.Unlock()
+
+	return session.Close()
+}
+
+func (l *serialYamuxListener) Close() error {
+	l.markClosing()
+
+	return l.closeCurrentSession()
+}
+
+func (l *serialYamuxListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.session.Addr()
+}
+
+// markClosing flags the listener as intentionally shutting down, so
+// Accept's reconnect loop gives up instead of racing a concurrent
+// teardown, and returns the close channel of whichever session was
+// current at the time of the call.
+func (l *serialYamuxListener) markClosing() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closing = true
+
+	return l.closeCh
+}
+
+func (l *serialYamuxListener) isClosing() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.closing
+}
+
+// yamuxNetError wraps a yamux error so that callers type-asserting for
+// net.Error (as the gRPC transport does, to distinguish retryable I/O
+// deadlines from fatal channel teardown) get sensible Timeout()/
+// Temporary() answers, mirroring upstream yamux's own NetError type.
+type yamuxNetError struct {
+	error
+}
+
+func (e *yamuxNetError) Timeout() bool {
+	return e.error == yamux.ErrTimeout || e.error == yamux.ErrKeepAliveTimeout
+}
+
+func (e *yamuxNetError) Temporary() bool {
+	switch e.error {
+	case yamux.ErrTimeout, yamux.ErrKeepAliveTimeout, yamux.ErrConnectionReset:
+		return true
+	default:
+		return false
+	}
+}
+
+// wrapYamuxErr wraps err, if non-nil and not already a net.Error, in a
+// yamuxNetError.
+func wrapYamuxErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return err
+	}
+
+	return &yamuxNetError{err}
+}
+
+// vhostVsockDriverSysfsPath is where the vhost_vsock driver exposes the
+// devices it is bound to. Its presence (with a bound device under it)
+// means a guest CID is actually attached, unlike merely having /dev/vsock
+// and a working AF_VSOCK socket() call, which some kernels allow even
+// without a hot-plugged vhost-vsock device.
+var vhostVsockDriverSysfsPath = "/sys/bus/vhost/drivers/vhost_vsock/"
+
+// isAFVSockSupported reports whether this guest has a vhost-vsock device
+// actually bound to it, by checking for bound devices under the
+// vhost_vsock driver's sysfs directory rather than relying on AF_VSOCK
+// socket() succeeding, which can be true even without a hot-plugged
+// device on some kernels.
 func isAFVSockSupported() (bool, error) {
-	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM, 0)
+	entries, err := ioutil.ReadDir(vhostVsockDriverSysfsPath)
 	if err != nil {
-		// This case is valid. It means AF_VSOCK is not a supported
-		// domain on this system.
-		if err == unix.EAFNOSUPPORT {
+		if os.IsNotExist(err) {
 			return false, nil
 		}
 
 		return false, err
 	}
 
-	if err := unix.Close(fd); err != nil {
-		return true, err
+	for _, entry := range entries {
+		// Bound vhost-vsock devices appear as numerically named entries
+		// (e.g. "1", "2", ...); the driver directory itself also holds
+		// non-device control files such as "bind", "unbind" and "uevent".
+		if _, err := strconv.Atoi(entry.Name()); err == nil {
+			return true, nil
+		}
 	}
 
-	return true, nil
+	return false, nil
 }
 
 func findVirtualSerialPath(serialName string) (string, error) {
@@ -0,0 +1,145 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withCmdline writes contents to a temp file, points procCmdlineFile at it
+// for the duration of fn, and restores the previous value afterwards.
+func withCmdline(t *testing.T, contents string, fn func()) {
+	dir, err := ioutil.TempDir("", "channel-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cmdline")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	old := procCmdlineFile
+	procCmdlineFile = path
+	defer func() { procCmdlineFile = old }()
+
+	fn()
+}
+
+func TestExplicitCommType(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    commType
+		wantErr bool
+	}{
+		{cmdline: "", want: unknownCh},
+		{cmdline: "quiet root=/dev/vda1", want: unknownCh},
+		{cmdline: "agent.channel=serial", want: serialCh},
+		{cmdline: "agent.channel=vsock", want: vsockCh},
+		{cmdline: "agent.channel=hybrid-vsock", want: hybridVSockCh},
+		{cmdline: "agent.channel=hvsock", want: hybridVSockCh},
+		{cmdline: "agent.channel=unix", want: unixCh},
+		{cmdline: "agent.channel=bogus", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.cmdline, func(t *testing.T) {
+			withCmdline(t, tt.cmdline, func() {
+				got, err := explicitCommType()
+				if tt.wantErr {
+					if err == nil {
+						t.Fatalf("explicitCommType(%q): expected an error, got none", tt.cmdline)
+					}
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("explicitCommType(%q): unexpected error: %v", tt.cmdline, err)
+				}
+
+				if got != tt.want {
+					t.Fatalf("explicitCommType(%q) = %v, want %v", tt.cmdline, got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+// TestNewChannelUnixBypass checks that newChannel routes straight to a
+// unixChannel when agent.unix_socket_path is set, without probing for vsock
+// or serial devices.
+func TestNewChannelUnixBypass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "channel-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sockPath := filepath.Join(dir, "agent.sock")
+
+	withCmdline(t, "agent.channel=unix agent.unix_socket_path="+sockPath, func() {
+		ch, err := newChannel(context.Background())
+		if err != nil {
+			t.Fatalf("newChannel: unexpected error: %v", err)
+		}
+
+		uc, ok := ch.(*unixChannel)
+		if !ok {
+			t.Fatalf("newChannel returned %T, want *unixChannel", ch)
+		}
+
+		if uc.socketPath != sockPath {
+			t.Fatalf("unixChannel.socketPath = %q, want %q", uc.socketPath, sockPath)
+		}
+	})
+}
+
+// TestNewChannelHybridVSockBypass checks that newChannel routes straight to
+// a hybridVSockChannel when agent.hybrid_vsock_path is set, without probing
+// for vsock or serial devices.
+func TestNewChannelHybridVSockBypass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "channel-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sockPath := filepath.Join(dir, "hvsock.sock")
+
+	withCmdline(t, "agent.channel=hybrid-vsock agent.hybrid_vsock_path="+sockPath, func() {
+		ch, err := newChannel(context.Background())
+		if err != nil {
+			t.Fatalf("newChannel: unexpected error: %v", err)
+		}
+
+		hc, ok := ch.(*hybridVSockChannel)
+		if !ok {
+			t.Fatalf("newChannel returned %T, want *hybridVSockChannel", ch)
+		}
+
+		if hc.hostSocketPath != sockPath {
+			t.Fatalf("hybridVSockChannel.hostSocketPath = %q, want %q", hc.hostSocketPath, sockPath)
+		}
+	})
+}
+
+// TestNewChannelUnixRequestedWithoutPath checks that requesting the unix
+// channel type without also providing a socket path is a configuration
+// error, not a silent fallback to probing.
+func TestNewChannelUnixRequestedWithoutPath(t *testing.T) {
+	withCmdline(t, "agent.channel=unix", func() {
+		if _, err := newChannel(context.Background()); err == nil {
+			t.Fatal("newChannel: expected an error when agent.unix_socket_path is unset, got none")
+		}
+	})
+}
@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// channelEpollMaxEvents bounds how many events channelEpoller.run will
+// drain from a single EpollWait call, modeled on containerd's console
+// Epoller.
+const channelEpollMaxEvents = 128
+
+// epoller is implemented by channels that want to be multiplexed onto a
+// shared channelEpoller instead of running their own private epoll loop
+// in wait(). This lets several channels (e.g. the main gRPC channel, a
+// log-forwarding channel and a debug-console channel) share a single
+// EpollCreate1(EPOLL_CLOEXEC) instance.
+type epoller interface {
+	channel
+	fd() int32
+	onEvent(events uint32) error
+}
+
+// channelEpoller dispatches EPOLLOUT/EPOLLHUP/EPOLLERR events for
+// multiple registered channel FDs from a single epoll instance, handing
+// each event to its channel's onEvent in its own goroutine.
+type channelEpoller struct {
+	epfd int
+
+	mu       sync.Mutex
+	handlers map[int32]epoller
+}
+
+func newChannelEpoller() (*channelEpoller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	return &channelEpoller{
+		epfd:     epfd,
+		handlers: make(map[int32]epoller),
+	}, nil
+}
+
+// add registers ch for edge-triggered EPOLLOUT/EPOLLHUP/EPOLLERR events.
+func (e *channelEpoller) add(ch epoller) error {
+	fd := ch.fd()
+
+	// EPOLLOUT: writable when there is a connection.
+	// EPOLLET: edge-triggered, as EPOLLHUP is always set when there is no
+	// connection yet.
+	// 0xffffffff: EPOLLET is negative and cannot fit in uint32 in golang.
+	event := unix.EpollEvent{
+		Events: unix.EPOLLOUT | unix.EPOLLET&0xffffffff,
+		Fd:     fd,
+	}
+
+	e.mu.Lock()
+	e.handlers[fd] = ch
+	e.mu.Unlock()
+
+	if err := unix.EpollCtl(e.epfd, unix.EPOLL_CTL_ADD, int(fd), &event); err != nil {
+		e.mu.Lock()
+		delete(e.handlers, fd)
+		e.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// remove unregisters ch. Errors from EpollCtl are ignored: the FD is
+// commonly already gone by the time teardown happens.
+func (e *channelEpoller) remove(ch epoller) {
+	fd := ch.fd()
+
+	unix.EpollCtl(e.epfd, unix.EPOLL_CTL_DEL, int(fd), nil)
+
+	e.mu.Lock()
+	delete(e.handlers, fd)
+	e.mu.Unlock()
+}
+
+// run polls for events until ctx is cancelled, dispatching each one to
+// the registered channel's onEvent. Meant to be run in its own goroutine.
+func (e *channelEpoller) run(ctx context.Context) {
+	var events [channelEpollMaxEvents]unix.EpollEvent
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		nev, err := unix.EpollWait(e.epfd, events[:], -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+
+			agentLog.WithError(err).Error("channel epoller wait failed")
+			return
+		}
+
+		for i := 0; i < nev; i++ {
+			ev := events[i]
+
+			e.mu.Lock()
+			ch, ok := e.handlers[ev.Fd]
+			e.mu.Unlock()
+
+			if !ok {
+				continue
+			}
+
+			go func(ch epoller, events uint32) {
+				if err := ch.onEvent(events); err != nil {
+					agentLog.WithError(err).WithField("fd", ch.fd()).Warn("channel epoller handler failed")
+				}
+			}(ch, ev.Events)
+		}
+	}
+}
+
+func (e *channelEpoller) close() error {
+	return unix.Close(e.epfd)
+}
+
+var (
+	sharedChannelEpoller     *channelEpoller
+	sharedChannelEpollerErr  error
+	sharedChannelEpollerOnce sync.Once
+)
+
+// getSharedChannelEpoller lazily creates the process-wide channelEpoller
+// and starts its dispatch loop, so every epoller channel in the agent
+// shares a single epoll instance. serialChannel is currently the only
+// channel that implements epoller; logChannel does not register with it.
+func getSharedChannelEpoller() (*channelEpoller, error) {
+	sharedChannelEpollerOnce.Do(func() {
+		sharedChannelEpoller, sharedChannelEpollerErr = newChannelEpoller()
+		if sharedChannelEpollerErr == nil {
+			go sharedChannelEpoller.run(context.Background())
+		}
+	})
+
+	return sharedChannelEpoller, sharedChannelEpollerErr
+}
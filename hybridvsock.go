@@ -0,0 +1,196 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hybridVSockHandshakeTimeout bounds how long Accept() will wait for the
+// "CONNECT <port>\n" line before giving up on a connection.
+var hybridVSockHandshakeTimeout = 5 * time.Second
+
+// Handshake reply lines. The client blocks waiting for one of these after
+// sending "CONNECT <port>\n" before it starts sending payload, mirroring
+// the ack upstream Firecracker/Hypervisor.framework hybrid-vsock
+// implementations expect.
+const (
+	hybridVSockHandshakeOK      = "OK\n"
+	hybridVSockHandshakeNoMatch = "NOMATCH\n"
+)
+
+// hybridVSockChannel speaks the "hybrid vsock" protocol used by
+// Firecracker and Apple's Hypervisor.framework: the agent listens on a
+// host-provided AF_UNIX socket, and each incoming connection is really a
+// multiplexed vsock port that starts with an ASCII "CONNECT <port>\n"
+// handshake line before the actual payload.
+type hybridVSockChannel struct {
+	// hostSocketPath is the AF_UNIX socket path provided by the host.
+	hostSocketPath string
+}
+
+func (c *hybridVSockChannel) setup() error {
+	return nil
+}
+
+func (c *hybridVSockChannel) wait() error {
+	return nil
+}
+
+func (c *hybridVSockChannel) listen() (net.Listener, error) {
+	// Remove any stale socket left behind by a previous agent instance;
+	// net.Listen("unix", ...) refuses to bind over an existing file.
+	if err := os.Remove(c.hostSocketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", c.hostSocketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHybridVSockListener(ln), nil
+}
+
+// teardown unlinks the host socket file. It does not close the listener
+// returned from listen(): the gRPC server built on top of it closes that
+// same listener as part of its own Stop(), same as vSockChannel and
+// unixChannel. Closing it again here would just
+// double-close it and return a spurious "use of closed network
+// connection" error on every normal agent shutdown.
+func (c *hybridVSockChannel) teardown() error {
+	if err := os.Remove(c.hostSocketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// hybridVSockListener wraps a net.Listener over an AF_UNIX socket, parsing
+// and stripping the hybrid vsock "CONNECT <port>\n" handshake from each
+// accepted connection before handing it to the caller, so the rest of the
+// agent can treat it like any other vsock.Conn.
+type hybridVSockListener struct {
+	ln net.Listener
+}
+
+func newHybridVSockListener(ln net.Listener) net.Listener {
+	return &hybridVSockListener{ln: ln}
+}
+
+func (l *hybridVSockListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		reader := bufio.NewReader(conn)
+		if err := readHybridVSockHandshake(conn, reader); err != nil {
+			agentLog.WithError(err).Warn("Dropping hybrid vsock connection with bad handshake")
+			writeHybridVSockHandshakeReply(conn, hybridVSockHandshakeNoMatch)
+			conn.Close()
+			continue
+		}
+
+		if _, err := conn.Write([]byte(hybridVSockHandshakeOK)); err != nil {
+			agentLog.WithError(err).Warn("Failed to ack hybrid vsock handshake")
+			conn.Close()
+			continue
+		}
+
+		return &hybridVSockConn{Conn: conn, r: reader}, nil
+	}
+}
+
+// writeHybridVSockHandshakeReply best-effort writes reply to conn. Errors
+// are ignored: conn is about to be closed by the caller either way.
+func writeHybridVSockHandshakeReply(conn net.Conn, reply string) {
+	conn.Write([]byte(reply))
+}
+
+func (l *hybridVSockListener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *hybridVSockListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// readHybridVSockHandshake reads and validates the "CONNECT <port>\n" line
+// a hybrid vsock client is expected to send as soon as it connects.
+func readHybridVSockHandshake(conn net.Conn, reader *bufio.Reader) error {
+	if err := conn.SetReadDeadline(time.Now().Add(hybridVSockHandshakeTimeout)); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "CONNECT" {
+		return fmt.Errorf("malformed hybrid vsock handshake: %q", line)
+	}
+
+	if _, err := strconv.ParseUint(fields[1], 10, 32); err != nil {
+		return fmt.Errorf("malformed hybrid vsock handshake port %q: %v", fields[1], err)
+	}
+
+	return nil
+}
+
+// hybridVSockConn is a net.Conn whose Read replays any bytes the
+// handshake parser buffered past the "CONNECT <port>\n" line before
+// falling through to the underlying connection.
+type hybridVSockConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *hybridVSockConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialHybridVSock dials a hybrid vsock endpoint and performs the
+// "CONNECT <port>\n" handshake expected by the listening side. It mirrors
+// the protocol spoken by Firecracker/Hypervisor.framework hybrid-vsock
+// implementations, and is mainly useful for tools and tests that need to
+// talk to a hybridVSockChannel without a real VMM in the loop.
+func dialHybridVSock(hostSocketPath string, port uint32) (net.Conn, error) {
+	conn, err := net.Dial("unix", hostSocketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if reply != hybridVSockHandshakeOK {
+		conn.Close()
+		return nil, fmt.Errorf("hybrid vsock handshake rejected: %q", strings.TrimSpace(reply))
+	}
+
+	return &hybridVSockConn{Conn: conn, r: reader}, nil
+}
@@ -0,0 +1,192 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadHybridVSockHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		wantErr bool
+	}{
+		{name: "valid", line: "CONNECT 1024\n"},
+		{name: "not CONNECT", line: "HELLO 1024\n", wantErr: true},
+		{name: "missing port", line: "CONNECT\n", wantErr: true},
+		{name: "extra field", line: "CONNECT 1024 extra\n", wantErr: true},
+		{name: "non-numeric port", line: "CONNECT abc\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- readHybridVSockHandshake(server, bufio.NewReader(server))
+			}()
+
+			if _, err := client.Write([]byte(tt.line)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+
+			select {
+			case err := <-errCh:
+				if tt.wantErr && err == nil {
+					t.Fatalf("readHybridVSockHandshake(%q): expected an error, got none", tt.line)
+				}
+				if !tt.wantErr && err != nil {
+					t.Fatalf("readHybridVSockHandshake(%q): unexpected error: %v", tt.line, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for readHybridVSockHandshake")
+			}
+		})
+	}
+}
+
+func TestReadHybridVSockHandshakeTimeout(t *testing.T) {
+	old := hybridVSockHandshakeTimeout
+	hybridVSockHandshakeTimeout = 50 * time.Millisecond
+	defer func() { hybridVSockHandshakeTimeout = old }()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	if err := readHybridVSockHandshake(server, bufio.NewReader(server)); err == nil {
+		t.Fatal("readHybridVSockHandshake: expected a deadline error when the client sends nothing, got none")
+	}
+}
+
+func newTestHybridVSockChannel(t *testing.T) *hybridVSockChannel {
+	dir, err := ioutil.TempDir("", "hybridvsock-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return &hybridVSockChannel{hostSocketPath: filepath.Join(dir, "hvsock.sock")}
+}
+
+// TestHybridVSockAcceptDialRoundTrip exercises the real listener/dialer
+// pair end to end: a well-formed CONNECT handshake should be acked with
+// "OK\n" and hand back a conn that can carry payload, with no leftover
+// handshake bytes visible to the reader.
+func TestHybridVSockAcceptDialRoundTrip(t *testing.T) {
+	c := newTestHybridVSockChannel(t)
+
+	ln, err := c.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	serverConnCh := make(chan net.Conn, 1)
+	serverErrCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		serverConnCh <- conn
+	}()
+
+	client, err := dialHybridVSock(c.hostSocketPath, 1024)
+	if err != nil {
+		t.Fatalf("dialHybridVSock: %v", err)
+	}
+	defer client.Close()
+
+	var server net.Conn
+	select {
+	case server = <-serverConnCh:
+	case err := <-serverErrCh:
+		t.Fatalf("Accept: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Accept")
+	}
+	defer server.Close()
+
+	payload := []byte("hello")
+	if _, err := client.Write(payload); err != nil {
+		t.Fatalf("client Write: %v", err)
+	}
+
+	buf := make([]byte, len(payload))
+	if _, err := server.Read(buf); err != nil {
+		t.Fatalf("server Read: %v", err)
+	}
+	if string(buf) != string(payload) {
+		t.Fatalf("server Read = %q, want %q (handshake bytes leaked into payload?)", buf, payload)
+	}
+}
+
+// TestHybridVSockAcceptRejectsMalformedHandshake checks that a connection
+// sending a malformed handshake line gets a NOMATCH reply and is dropped,
+// without taking down the listener for subsequent, well-formed clients.
+func TestHybridVSockAcceptRejectsMalformedHandshake(t *testing.T) {
+	c := newTestHybridVSockChannel(t)
+
+	ln, err := c.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	acceptedCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			acceptedCh <- conn
+		}
+	}()
+
+	bad, err := net.Dial("unix", c.hostSocketPath)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer bad.Close()
+
+	if _, err := bad.Write([]byte("GARBAGE\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	reply := make([]byte, len(hybridVSockHandshakeNoMatch))
+	if _, err := bad.Read(reply); err != nil {
+		t.Fatalf("Read reply: %v", err)
+	}
+	if string(reply) != hybridVSockHandshakeNoMatch {
+		t.Fatalf("reply = %q, want %q", reply, hybridVSockHandshakeNoMatch)
+	}
+
+	// The listener should still be usable for a well-formed client.
+	good, err := dialHybridVSock(c.hostSocketPath, 1024)
+	if err != nil {
+		t.Fatalf("dialHybridVSock after a bad peer: %v", err)
+	}
+	defer good.Close()
+
+	select {
+	case conn := <-acceptedCh:
+		conn.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Accept to succeed for the well-formed client")
+	}
+}
@@ -0,0 +1,250 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultLogChannelName is the virtio-serial port name the log channel
+// looks for via findVirtualSerialPath, parallel to the data-plane
+// serialChannelName.
+const defaultLogChannelName = "agent.log"
+
+// logChannelNameCmdlineOption overrides defaultLogChannelName.
+const logChannelNameCmdlineOption = "agent.log_channel_name"
+
+// logRecord is one structured entry written to the log channel: agent and
+// workload stdout/stderr, or a structured log line, tagged with its
+// source so host-side tooling can tell them apart.
+type logRecord struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// logChannel is a side-channel, parallel to the data-plane channel, that
+// streams agentLog output (and anything else written through a
+// logChannelWriter) to the host over a secondary virtio-serial port as a
+// framed (length-prefixed JSON) protocol. Container I/O is not teed into
+// it: see setupAgentLogChannel. It's
+// meant for host-side log collectors that multiplex kernel, agent and
+// workload output on separate TTYs, and keeps working even when the main
+// gRPC channel is saturated or wedged.
+//
+// A logChannel whose port isn't present degrades gracefully: writeRecord
+// becomes a no-op instead of failing the caller, matching the agent's
+// current behavior of simply not having a log side-channel.
+type logChannel struct {
+	portName   string
+	serialPath string
+
+	mu   sync.Mutex
+	conn *os.File
+}
+
+// newOptionalLogChannel looks up portName via findVirtualSerialPath and
+// opens it, but degrades gracefully (returning a logChannel whose writes
+// are no-ops) if the port isn't there, e.g. an older runtime that doesn't
+// plug a log port in.
+func newOptionalLogChannel(portName string) *logChannel {
+	l := &logChannel{portName: portName}
+
+	if err := l.setup(); err != nil {
+		agentLog.WithError(err).WithField("port", portName).Debug("Log channel port not available, logs will not be teed to it")
+	}
+
+	return l
+}
+
+// cmdlineLogChannelName returns the virtio-serial port name to use for the
+// log channel, honoring an "agent.log_channel_name=" override on the
+// kernel cmdline and falling back to defaultLogChannelName otherwise.
+func cmdlineLogChannelName() (string, error) {
+	value, err := getCmdlineOption(logChannelNameCmdlineOption)
+	if err != nil {
+		return "", err
+	}
+
+	if value == "" {
+		return defaultLogChannelName, nil
+	}
+
+	return value, nil
+}
+
+func (l *logChannel) setup() error {
+	path, err := findVirtualSerialPath(l.portName)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY, os.ModeDevice)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.serialPath = path
+	l.conn = file
+	l.mu.Unlock()
+
+	return nil
+}
+
+func (l *logChannel) teardown() error {
+	l.mu.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	return conn.Close()
+}
+
+// writeRecord frames rec as a 4-byte big-endian length prefix followed by
+// its JSON encoding, and writes it to the log port. It is a no-op if the
+// port was never available.
+func (l *logChannel) writeRecord(rec logRecord) error {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := conn.Write(header[:]); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(payload); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// logChannelWriter adapts a logChannel to io.Writer, tagging every Write
+// with a source name, so it can be handed to agentLog as an extra output
+// or used by the container I/O forwarders to tee stdout/stderr into the
+// log channel.
+type logChannelWriter struct {
+	ch     *logChannel
+	source string
+}
+
+func newLogChannelWriter(ch *logChannel, source string) *logChannelWriter {
+	return &logChannelWriter{ch: ch, source: source}
+}
+
+func (w *logChannelWriter) Write(p []byte) (int, error) {
+	rec := logRecord{
+		Time:    time.Now(),
+		Source:  w.source,
+		Message: string(p),
+	}
+
+	if err := w.ch.writeRecord(rec); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+var (
+	agentLogChannel     *logChannel
+	agentLogChannelOnce sync.Once
+)
+
+// setupAgentLogChannel opens the optional log side-channel (see
+// newOptionalLogChannel) and adds a logrus hook that tees every agentLog
+// entry into it, in addition to agentLog's normal output, so host-side
+// log collectors keep getting real-time agent logs even when the main
+// gRPC channel is saturated or wedged. It's called once from newChannel,
+// the closest thing this package has to an agent bootstrap hook.
+//
+// This only covers agentLog itself. This tree has no container I/O
+// forwarding code to hook the log channel into yet; newLogChannelWriter
+// is a separate helper so that code can tee a container's stdout/stderr into the
+// same channel, tagged with its container ID, once it exists.
+func setupAgentLogChannel() {
+	agentLogChannelOnce.Do(func() {
+		name, err := cmdlineLogChannelName()
+		if err != nil {
+			agentLog.WithError(err).Warn("Invalid log channel name, falling back to default")
+			name = defaultLogChannelName
+		}
+
+		agentLogChannel = newOptionalLogChannel(name)
+		agentLog.Logger.AddHook(&logChannelHook{writer: newLogChannelWriter(agentLogChannel, "agent")})
+	})
+}
+
+// logChannelHook is a logrus.Hook that tees every log entry into a
+// logChannel.
+type logChannelHook struct {
+	writer *logChannelWriter
+}
+
+func (h *logChannelHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logChannelHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.writer.Write([]byte(line))
+	return err
+}
+
+// readLogRecord reads one length-prefixed JSON log record from r, as
+// written by logChannel/logChannelWriter. This is the host-side
+// counterpart used by serial-console log collectors.
+func readLogRecord(r io.Reader) (logRecord, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return logRecord{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return logRecord{}, err
+	}
+
+	var rec logRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return logRecord{}, err
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogChannelWriteRecordRoundTrip(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	lc := &logChannel{conn: w}
+
+	rec := logRecord{
+		Time:    time.Unix(1000, 0).UTC(),
+		Source:  "agent",
+		Message: "hello world",
+	}
+
+	if err := lc.writeRecord(rec); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+
+	got, err := readLogRecord(r)
+	if err != nil {
+		t.Fatalf("readLogRecord: %v", err)
+	}
+
+	if !got.Time.Equal(rec.Time) || got.Source != rec.Source || got.Message != rec.Message {
+		t.Fatalf("readLogRecord = %+v, want %+v", got, rec)
+	}
+}
+
+// TestLogChannelWriteRecordNoopWhenPortAbsent checks that writeRecord
+// degrades gracefully instead of failing the caller when the log channel
+// port was never available (see newOptionalLogChannel).
+func TestLogChannelWriteRecordNoopWhenPortAbsent(t *testing.T) {
+	lc := &logChannel{}
+
+	if err := lc.writeRecord(logRecord{Message: "ignored"}); err != nil {
+		t.Fatalf("writeRecord on a portless logChannel: %v", err)
+	}
+}
+
+func TestLogChannelWriterTagsSource(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	lc := &logChannel{conn: w}
+	writer := newLogChannelWriter(lc, "container-123")
+
+	n, err := writer.Write([]byte("stdout line"))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n != len("stdout line") {
+		t.Fatalf("Write returned n=%d, want %d", n, len("stdout line"))
+	}
+
+	got, err := readLogRecord(r)
+	if err != nil {
+		t.Fatalf("readLogRecord: %v", err)
+	}
+
+	if got.Source != "container-123" || got.Message != "stdout line" {
+		t.Fatalf("readLogRecord = %+v, want source=%q message=%q", got, "container-123", "stdout line")
+	}
+}
+
+func TestLogChannelTeardownClosesConn(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+
+	lc := &logChannel{conn: w}
+
+	if err := lc.teardown(); err != nil {
+		t.Fatalf("teardown: %v", err)
+	}
+
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Fatal("conn still writable after teardown, want it closed")
+	}
+
+	if err := lc.writeRecord(logRecord{Message: "after teardown"}); err != nil {
+		t.Fatalf("writeRecord after teardown: %v", err)
+	}
+}
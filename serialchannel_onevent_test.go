@@ -0,0 +1,65 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestSerialChannelOnEventPrecedence guards the original wait() semantics
+// that the chunk0-3 epoller refactor briefly inverted: a writable event
+// (EPOLLOUT) must win over an error event (EPOLLERR) reported on the same
+// epoll_wait() call, not the other way around.
+func TestSerialChannelOnEventPrecedence(t *testing.T) {
+	c := &serialChannel{waitResult: make(chan error, 1)}
+
+	if err := c.onEvent(unix.EPOLLOUT | unix.EPOLLERR); err != nil {
+		t.Fatalf("onEvent: unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-c.waitResult:
+		if err != nil {
+			t.Fatalf("waitResult = %v, want nil (EPOLLOUT should win over EPOLLERR)", err)
+		}
+	default:
+		t.Fatal("onEvent did not signal waitResult")
+	}
+}
+
+func TestSerialChannelOnEventErrorOnly(t *testing.T) {
+	c := &serialChannel{waitResult: make(chan error, 1)}
+
+	if err := c.onEvent(unix.EPOLLERR); err != nil {
+		t.Fatalf("onEvent: unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-c.waitResult:
+		if err == nil {
+			t.Fatal("waitResult = nil, want an error for a bare EPOLLERR event")
+		}
+	default:
+		t.Fatal("onEvent did not signal waitResult")
+	}
+}
+
+func TestSerialChannelOnEventHupOnlyDoesNotSignal(t *testing.T) {
+	c := &serialChannel{waitResult: make(chan error, 1)}
+
+	if err := c.onEvent(unix.EPOLLHUP); err != nil {
+		t.Fatalf("onEvent: unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-c.waitResult:
+		t.Fatalf("onEvent signaled waitResult = %v for a bare EPOLLHUP, want no signal (no connection yet)", err)
+	default:
+	}
+}
@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/yamux"
+)
+
+func newTestSerialChannel(t *testing.T) *serialChannel {
+	dir, err := ioutil.TempDir("", "serialchannel-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "serial")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	return &serialChannel{serialPath: path}
+}
+
+// TestReopenSerialConn checks that reopenSerialConn replaces serialConn
+// with a fresh, independently-opened *os.File rather than reusing the one
+// that a keepalive-triggered yamux Close() already closed out from under
+// it (see the reconnect fix in serialYamuxListener.reconnect).
+func TestReopenSerialConn(t *testing.T) {
+	c := newTestSerialChannel(t)
+
+	if err := c.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	firstConn := c.serialConn
+	firstFd := firstConn.Fd()
+
+	// Simulate what yamux.Session.Close() does internally on a keepalive
+	// timeout: close the underlying file out from under the channel.
+	firstConn.Close()
+
+	if err := c.reopenSerialConn(); err != nil {
+		t.Fatalf("reopenSerialConn: %v", err)
+	}
+
+	c.connMu.Lock()
+	newConn := c.serialConn
+	c.connMu.Unlock()
+
+	if newConn == firstConn {
+		t.Fatal("reopenSerialConn did not replace serialConn")
+	}
+
+	if newConn.Fd() == firstFd {
+		t.Fatal("reopenSerialConn reused the old, already-closed file descriptor")
+	}
+
+	if _, err := newConn.Write([]byte("x")); err != nil {
+		t.Fatalf("write on reopened serialConn: %v", err)
+	}
+}
+
+func TestWrapYamuxErr(t *testing.T) {
+	if err := wrapYamuxErr(nil); err != nil {
+		t.Fatalf("wrapYamuxErr(nil) = %v, want nil", err)
+	}
+
+	plain := errors.New("boom")
+	wrapped := wrapYamuxErr(plain)
+
+	netErr, ok := wrapped.(interface {
+		Timeout() bool
+		Temporary() bool
+	})
+	if !ok {
+		t.Fatalf("wrapYamuxErr(%v) does not implement net.Error", plain)
+	}
+	if netErr.Timeout() || netErr.Temporary() {
+		t.Fatalf("wrapYamuxErr(%v): Timeout()=%v Temporary()=%v, want both false for a generic error", plain, netErr.Timeout(), netErr.Temporary())
+	}
+
+	timeoutWrapped := wrapYamuxErr(yamux.ErrKeepAliveTimeout)
+	timeoutNetErr := timeoutWrapped.(interface {
+		Timeout() bool
+		Temporary() bool
+	})
+	if !timeoutNetErr.Timeout() || !timeoutNetErr.Temporary() {
+		t.Fatalf("wrapYamuxErr(yamux.ErrKeepAliveTimeout): Timeout()=%v Temporary()=%v, want both true", timeoutNetErr.Timeout(), timeoutNetErr.Temporary())
+	}
+
+	// Already a net.Error: passed through unchanged, not double-wrapped.
+	if wrapYamuxErr(timeoutWrapped) != timeoutWrapped {
+		t.Fatal("wrapYamuxErr re-wrapped an error that already implements net.Error")
+	}
+}
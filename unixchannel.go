@@ -0,0 +1,192 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cmdline/env options selecting the AF_UNIX dev/test channel, used to run
+// the agent on a developer workstation or in CI without a vsock-capable
+// kernel or a virtio-serial device. The env var takes precedence, since in
+// this mode the agent is often started outside a VM with no meaningful
+// kernel cmdline to read.
+const (
+	unixSocketPathCmdlineOption        = "agent.unix_socket_path"
+	unixSocketPathEnvVar               = "KATA_AGENT_UNIX_SOCKET"
+	unixSocketAllowedUIDsCmdlineOption = "agent.unix_socket_allowed_uids"
+
+	defaultUnixSocketFileMode = os.FileMode(0600)
+)
+
+// cmdlineUnixSocketPath returns the AF_UNIX socket path to listen on, from
+// either unixSocketPathEnvVar or the "agent.unix_socket_path=" kernel
+// cmdline option, or the empty string if neither was set.
+func cmdlineUnixSocketPath() (string, error) {
+	if value := os.Getenv(unixSocketPathEnvVar); value != "" {
+		return value, nil
+	}
+
+	return getCmdlineOption(unixSocketPathCmdlineOption)
+}
+
+// cmdlineUnixSocketAllowedUIDs parses the optional comma-separated
+// "agent.unix_socket_allowed_uids=" cmdline option into a set of allowed
+// peer UIDs. A nil/empty result means "accept any peer".
+func cmdlineUnixSocketAllowedUIDs() (map[uint32]struct{}, error) {
+	value, err := getCmdlineOption(unixSocketAllowedUIDsCmdlineOption)
+	if err != nil {
+		return nil, err
+	}
+
+	if value == "" {
+		return nil, nil
+	}
+
+	uids := make(map[uint32]struct{})
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q: %v", unixSocketAllowedUIDsCmdlineOption, field, err)
+		}
+
+		uids[uint32(uid)] = struct{}{}
+	}
+
+	return uids, nil
+}
+
+// unixChannel is a channel implementation that listens on a configurable
+// AF_UNIX socket path, so the agent can be exercised on a developer
+// workstation or in CI without a vsock-capable kernel or a virtio-serial
+// device.
+type unixChannel struct {
+	socketPath string
+	fileMode   os.FileMode
+	// allowedUIDs, when non-empty, restricts accepted connections to
+	// peers whose SO_PEERCRED UID is in the set.
+	allowedUIDs map[uint32]struct{}
+}
+
+func (c *unixChannel) setup() error {
+	// net.ListenUnix refuses to bind over an existing socket file.
+	if err := os.Remove(c.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *unixChannel) wait() error {
+	return nil
+}
+
+func (c *unixChannel) listen() (net.Listener, error) {
+	addr, err := net.ResolveUnixAddr("unix", c.socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := c.fileMode
+	if mode == 0 {
+		mode = defaultUnixSocketFileMode
+	}
+
+	if err := os.Chmod(c.socketPath, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return &unixPeerCredListener{UnixListener: ln, allowedUIDs: c.allowedUIDs}, nil
+}
+
+// teardown unlinks the socket file. It does not close the net.Listener
+// returned from listen(): the gRPC server built on top of it closes it as
+// part of its own Stop(), same as vSockChannel. Closing it again here would just
+// double-close it and return a spurious "use of closed network
+// connection" error.
+func (c *unixChannel) teardown() error {
+	if err := os.Remove(c.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// unixPeerCredListener wraps a *net.UnixListener, rejecting connections
+// from peers whose SO_PEERCRED UID isn't in allowedUIDs (when that set is
+// non-empty).
+type unixPeerCredListener struct {
+	*net.UnixListener
+	allowedUIDs map[uint32]struct{}
+}
+
+func (l *unixPeerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(l.allowedUIDs) == 0 {
+			return conn, nil
+		}
+
+		uid, err := unixConnPeerUID(conn)
+		if err != nil {
+			agentLog.WithError(err).Warn("Could not determine unix channel peer credentials, rejecting connection")
+			conn.Close()
+			continue
+		}
+
+		if _, ok := l.allowedUIDs[uid]; !ok {
+			agentLog.WithField("uid", uid).Warn("Rejecting unix channel connection from disallowed peer UID")
+			conn.Close()
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+// unixConnPeerUID returns the UID of the process on the other end of conn,
+// as reported by SO_PEERCRED.
+func unixConnPeerUID(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+
+	return cred.Uid, nil
+}
@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestUnixChannelServesGRPC spins up a gRPC server on a unixChannel's
+// listener, exactly as the agent's own gRPC server does in production, and
+// drives it with an in-process gRPC client dialed over the same socket.
+// This is the harness the chunk0-6 request asked for: it exercises the
+// channel the way the agent actually uses it (Listen -> grpc.Server.Serve,
+// then grpc.Dial against the socket path), rather than only unit-testing
+// unixChannel's methods in isolation. The real agent gRPC service isn't
+// available in this tree, so grpc/health stands in for it: any registered
+// service round-trips identically over this channel's net.Listener.
+func TestUnixChannelServesGRPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixchannel-grpc-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sockPath := filepath.Join(dir, "agent.sock")
+	c := &unixChannel{socketPath: sockPath}
+
+	if err := c.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	ln, err := c.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	healthSrv := health.NewServer()
+	healthSrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+
+	grpcSrv := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcSrv, healthSrv)
+
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- grpcSrv.Serve(ln)
+	}()
+
+	dialCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(dialCtx, sockPath,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("grpc.DialContext over unixChannel: %v", err)
+	}
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel2 := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel2()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Check over in-process gRPC client: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Check status = %v, want SERVING", resp.Status)
+	}
+
+	grpcSrv.GracefulStop()
+
+	if err := <-serveErrCh; err != nil && err != grpc.ErrServerStopped {
+		t.Fatalf("grpcSrv.Serve: %v", err)
+	}
+
+	if err := c.teardown(); err != nil {
+		t.Fatalf("teardown: %v", err)
+	}
+
+	if _, err := os.Stat(sockPath); !os.IsNotExist(err) {
+		t.Fatalf("socket file still present after teardown: %v", err)
+	}
+}
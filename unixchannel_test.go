@@ -0,0 +1,161 @@
+//
+// Copyright (c) 2017-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestUnixChannel(t *testing.T) (*unixChannel, string) {
+	dir, err := ioutil.TempDir("", "unixchannel-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sockPath := filepath.Join(dir, "agent.sock")
+	return &unixChannel{socketPath: sockPath}, sockPath
+}
+
+func TestUnixChannelSetupListenTeardown(t *testing.T) {
+	c, sockPath := newTestUnixChannel(t)
+
+	if err := c.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	ln, err := c.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	if _, err := os.Stat(sockPath); err != nil {
+		t.Fatalf("socket file not created: %v", err)
+	}
+
+	info, err := os.Stat(sockPath)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != defaultUnixSocketFileMode {
+		t.Fatalf("socket file mode = %v, want %v", perm, defaultUnixSocketFileMode)
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("listener Close: %v", err)
+	}
+
+	if err := c.teardown(); err != nil {
+		t.Fatalf("teardown: %v", err)
+	}
+
+	if _, err := os.Stat(sockPath); !os.IsNotExist(err) {
+		t.Fatalf("socket file still present after teardown: %v", err)
+	}
+}
+
+func TestUnixChannelSetupRemovesStaleSocket(t *testing.T) {
+	c, sockPath := newTestUnixChannel(t)
+
+	if err := ioutil.WriteFile(sockPath, []byte("stale"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := c.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	if _, err := c.listen(); err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+}
+
+// TestUnixPeerCredListenerRejectsDisallowedUID checks that connections from
+// peers whose SO_PEERCRED UID isn't in allowedUIDs are dropped rather than
+// handed to the caller.
+func TestUnixPeerCredListenerRejectsDisallowedUID(t *testing.T) {
+	c, _ := newTestUnixChannel(t)
+	c.allowedUIDs = map[uint32]struct{}{999999: {}}
+
+	if err := c.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	ln, err := c.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	addr := ln.Addr().String()
+
+	acceptErrCh := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		acceptErrCh <- err
+	}()
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// The real peer's UID is never in allowedUIDs (an invalid placeholder
+	// UID), so the listener should drop this connection and keep waiting
+	// rather than returning it to Accept's caller; closing the listener
+	// unblocks the goroutine with an error instead.
+	ln.Close()
+
+	if err := <-acceptErrCh; err == nil {
+		t.Fatal("Accept: expected an error after listener was closed while rejecting a peer, got none")
+	}
+}
+
+func TestUnixPeerCredListenerAllowsAnyPeerWhenUnset(t *testing.T) {
+	c, _ := newTestUnixChannel(t)
+
+	if err := c.setup(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	ln, err := c.listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	addr := ln.Addr().String()
+
+	connCh := make(chan net.Conn, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		connCh <- conn
+	}()
+
+	client, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case conn := <-connCh:
+		conn.Close()
+	case err := <-errCh:
+		t.Fatalf("Accept: %v", err)
+	}
+}